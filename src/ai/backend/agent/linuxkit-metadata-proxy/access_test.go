@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustSetPattern(t *testing.T, l *regexpList, pattern string) {
+	t.Helper()
+	if err := l.Set(pattern); err != nil {
+		t.Fatalf("Set(%q): %v", pattern, err)
+	}
+}
+
+func TestAccessPolicyGlobPatterns(t *testing.T) {
+	cases := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		path    string
+		permits bool
+	}{
+		{
+			name:    "glob allow matches one path segment",
+			allow:   []string{"glob:/session/*/files"},
+			path:    "/session/123/files",
+			permits: true,
+		},
+		{
+			name:    "glob allow does not cross path segments",
+			allow:   []string{"glob:/session/*/files"},
+			path:    "/session/123/456/files",
+			permits: false,
+		},
+		{
+			name:    "glob deny only matches its own segment, not a regexp repetition of the preceding char",
+			deny:    []string{"glob:/admin/*"},
+			path:    "/foo/admin/secretXYZ",
+			permits: true, // deny pattern is anchored to the start, so this unrelated path isn't denied
+		},
+		{
+			name:    "glob deny matches the path it documents",
+			deny:    []string{"glob:/admin/*"},
+			path:    "/admin/secretXYZ",
+			permits: false,
+		},
+		{
+			name:    "plain regexp is never reinterpreted as a glob",
+			allow:   []string{"/session/.*/files"},
+			path:    "/session/123/files",
+			permits: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var policy accessPolicy
+			for _, p := range tc.allow {
+				mustSetPattern(t, &policy.allow, p)
+			}
+			for _, p := range tc.deny {
+				mustSetPattern(t, &policy.deny, p)
+			}
+			if got := policy.permits(tc.path); got != tc.permits {
+				t.Fatalf("permits(%q) = %v, want %v", tc.path, got, tc.permits)
+			}
+		})
+	}
+}
+
+func TestRegexpListRejectsInvalidRegexp(t *testing.T) {
+	var l regexpList
+	if err := l.Set("("); err == nil {
+		t.Fatal("expected an error for an unbalanced, non-glob-prefixed pattern")
+	}
+}
+
+func TestTokenBucketAllowsUpToBurstThenBlocks(t *testing.T) {
+	b := &tokenBucket{tokens: 2, rate: 0, burst: 2, lastTime: time.Now()}
+	if !b.allow() {
+		t.Fatal("expected first request to be allowed")
+	}
+	if !b.allow() {
+		t.Fatal("expected second request within burst to be allowed")
+	}
+	if b.allow() {
+		t.Fatal("expected third request to be rate limited")
+	}
+}
+
+func TestClientRateLimiterIsolatesClientsByKey(t *testing.T) {
+	l := newClientRateLimiter(0, 1)
+	if !l.allow("client-a") {
+		t.Fatal("expected client-a's first request to be allowed")
+	}
+	if l.allow("client-a") {
+		t.Fatal("expected client-a's second request to be rate limited")
+	}
+	if !l.allow("client-b") {
+		t.Fatal("expected client-b to have its own independent bucket")
+	}
+}
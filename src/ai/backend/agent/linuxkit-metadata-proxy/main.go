@@ -1,83 +1,576 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
-	"net/url"
+	"net/http/httputil"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
-var hopHeaders = []string{
-	"Connection",
-	"Keep-Alive",
-	"Proxy-Authenticate",
-	"Proxy-Authorization",
-	"Te", // canonicalized version of "TE"
-	"Trailers",
-	"Transfer-Encoding",
-	"Upgrade",
-}
-
-func handleHTTP(w http.ResponseWriter, req *http.Request, remotePort int) {
-	req.URL = &url.URL{
-		Scheme:      "http",
-		Opaque:      req.URL.Opaque,
-		User:        req.URL.User,
-		Host:        "host.docker.internal:" + strconv.Itoa(remotePort),
-		Path:        req.URL.Path,
-		RawPath:     req.URL.RawPath,
-		ForceQuery:  req.URL.ForceQuery,
-		RawQuery:    req.URL.RawQuery,
-		Fragment:    req.URL.Fragment,
-		RawFragment: req.URL.RawFragment,
-	}
-	req.Host = "host.docker.internal:" + strconv.Itoa(remotePort)
-	log.Printf("%s %s\n", req.Method, req.URL)
-	delHopHeaders(req.Header)
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		req.Header.Set("X-Forwarded-For", clientIP)
-	}
-	resp, err := http.DefaultTransport.RoundTrip(req)
+// errorResponse is the JSON body returned by the proxy's ErrorHandler instead of the
+// plain-text body http.Error would otherwise produce, so agent-sidecar
+// consumers can parse proxy-side failures the same way they parse backend
+// errors.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// nonTrailerHeaders are field names that must never be promoted from a
+// response's trailer: the static hop-by-hop set plus the framing headers
+// RFC 7230 §4.1.2 forbids a trailer from redefining. This mirrors
+// golang.org/x/net/http/httpguts.ValidTrailerHeader without depending on
+// that module, since it's vendored inside net/http itself and isn't
+// importable from outside the standard library.
+var nonTrailerHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+}
+
+// validTrailerHeader reports whether name may legally be promoted from a
+// response trailer into the proxied response.
+func validTrailerHeader(name string) bool {
+	return !nonTrailerHeaders[http.CanonicalHeaderKey(name)]
+}
+
+// newMetadataProxy builds the reverse proxy that forwards requests to
+// backendAddr (normally the agent's metadata server at
+// host.docker.internal:remotePort). Using httputil.ReverseProxy gives us
+// Director-based URL rewriting, correct X-Forwarded-For append semantics,
+// trailer pass-through, and Upgrade tunneling for free, instead of
+// reimplementing each by hand. The director itself sets X-Forwarded-Host to
+// the client's original Host and X-Forwarded-Proto to the client's scheme.
+func newMetadataProxy(backendAddr string, flushInterval time.Duration, sessionID, agentHostname string, transport http.RoundTripper) *httputil.ReverseProxy {
+	director := func(req *http.Request) {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.URL.Scheme = "http"
+		req.URL.Host = backendAddr
+		req.Host = backendAddr
+		log.Printf("%s %s\n", req.Method, req.URL)
+	}
+	return &httputil.ReverseProxy{
+		Director:      director,
+		FlushInterval: flushInterval,
+		Transport:     transport,
+		ModifyResponse: func(resp *http.Response) error {
+			for name := range resp.Trailer {
+				if !validTrailerHeader(name) {
+					resp.Trailer.Del(name)
+				}
+			}
+			if sessionID != "" {
+				resp.Header.Set("X-BackendAI-Session-ID", sessionID)
+			}
+			if agentHostname != "" {
+				resp.Header.Set("X-BackendAI-Agent-Hostname", agentHostname)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("proxy error: %s %s: %v\n", req.Method, req.URL, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+		},
+	}
+}
+
+// defaultDenyPatterns covers known-sensitive IMDS-style metadata paths that
+// a compromised kernel should never be able to scrape from the agent's
+// metadata backend, regardless of what the operator passes via -deny.
+var defaultDenyPatterns = []string{
+	`^/latest/meta-data/iam/security-credentials(/|$)`,
+	`^/latest/api/token(/|$)`,
+	`^/latest/user-data(/|$)`,
+	`^/computeMetadata/.*/instance/service-accounts(/|$)`,
+}
+
+// globPatternPrefix marks a -allow/-deny occurrence as a shell-style glob
+// rather than a regexp. A pattern is interpreted as exactly one grammar: if
+// it carries this prefix it's a glob, otherwise it's always a regexp, even
+// if it happens to also be valid glob syntax (or vice versa). Guessing the
+// grammar from whether regexp.Compile happens to succeed is what caused
+// "/session/*/files" to silently compile as the regexp "/session/*/files"
+// (matching zero-or-more "/") instead of the intended glob.
+const globPatternPrefix = "glob:"
+
+// regexpList is a repeatable flag.Value that compiles each -allow/-deny
+// occurrence into a regexp matched against req.URL.Path. A "glob:"-prefixed
+// occurrence is translated from shell-style glob syntax first.
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, len(*l))
+	for i, re := range *l {
+		parts[i] = re.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *regexpList) Set(pattern string) error {
+	source := pattern
+	if strings.HasPrefix(pattern, globPatternPrefix) {
+		source = globToRegexpPattern(strings.TrimPrefix(pattern, globPatternPrefix))
+	}
+	re, err := regexp.Compile(source)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return fmt.Errorf("invalid -allow/-deny pattern %q: %w", pattern, err)
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+// globToRegexpPattern translates a shell-style glob (`*` any run of
+// characters other than "/", `?` a single non-"/" character) into an
+// equivalent anchored regexp source, so e.g. "glob:/session/*/files" matches
+// exactly one path segment in place of "*", the same as a shell glob would.
+func globToRegexpPattern(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// accessPolicy decides whether a request path may reach the backend. A path
+// matching any deny pattern is always rejected; otherwise, if an allowlist
+// was configured, the path must match one of its patterns.
+type accessPolicy struct {
+	allow regexpList
+	deny  regexpList
+}
+
+func (p *accessPolicy) permits(path string) bool {
+	for _, re := range p.deny {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, re := range p.allow {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket is a simple token-bucket rate limiter for a single client.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	rate     float64
+	burst    float64
+	lastTime time.Time
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.lastTime).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastTime = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientRateLimiter keys a tokenBucket per client address so one noisy
+// container can't starve the metadata server for its neighbors.
+type clientRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64
+	burst   float64
+}
+
+func newClientRateLimiter(rate float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   float64(burst),
+	}
+}
+
+func (l *clientRateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, rate: l.rate, burst: l.burst, lastTime: time.Now()}
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+	return b.allow()
+}
+
+// withAccessControl wraps next with the allow/deny path policy and the
+// per-client rate limiter, rejecting requests before they ever reach the
+// backend.
+func withAccessControl(next http.Handler, policy *accessPolicy, limiter *clientRateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !policy.permits(req.URL.Path) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		key := req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			key = host
+		}
+		if !limiter.allow(key) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// breakerState is a circuitBreaker's current posture toward the backend.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker trips to open after failThreshold consecutive backend
+// failures, short-circuiting further requests for cooldown before admitting
+// a single half-open trial request to probe whether the backend recovered.
+type circuitBreaker struct {
+	mu               sync.Mutex
+	state            breakerState
+	consecutiveFails int
+	failThreshold    int
+	cooldown         time.Duration
+	openedAt         time.Time
+	halfOpenInFlight bool
+}
+
+func newCircuitBreaker(failThreshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{failThreshold: failThreshold, cooldown: cooldown}
+}
+
+var errCircuitOpen = errors.New("circuit breaker open: backend is failing")
+
+// allow reports whether a request may be attempted, transitioning a tripped
+// breaker from open to half-open once cooldown has elapsed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.halfOpenInFlight = true
+		return true
+	case breakerHalfOpen:
+		if b.halfOpenInFlight {
+			return false
+		}
+		b.halfOpenInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.consecutiveFails = 0
+	b.halfOpenInFlight = false
+}
+
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenInFlight = false
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
 		return
 	}
-	defer resp.Body.Close()
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	b.consecutiveFails++
+	if b.consecutiveFails >= b.failThreshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
 }
 
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
+func (b *circuitBreaker) status() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
+
+// upgradeIdleTimeout bounds how long a connection to the backend (including
+// a tunneled Upgrade connection such as a WebSocket, which
+// httputil.ReverseProxy splices together with a plain io.Copy and no
+// deadline of its own) may go without a read or write before it is closed,
+// so a stuck backend or client can't leak a hijacked connection forever.
+var upgradeIdleTimeout = 1 * time.Hour
+
+// idleTimeoutConn sets a fresh read or write deadline before every Read and
+// Write call, turning upgradeIdleTimeout into an idle timeout rather than an
+// absolute connection lifetime.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// newBackendTransport builds the base http.Transport used to reach the
+// backend, with every dialed connection wrapped so it enforces
+// idleTimeout. This is what keeps a tunneled Upgrade connection from
+// leaking even though ReverseProxy's own upgrade handling has no deadline.
+func newBackendTransport(idleTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
 		}
+		return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+	}
+	return t
+}
+
+// maxBufferedBodySize bounds how large a retryable request body we'll buffer
+// in memory to allow rewinding it across retry attempts.
+const maxBufferedBodySize = 1 << 20 // 1 MiB
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRetryableTransportError reports whether err looks like a transient
+// dial/connection failure worth retrying, as opposed to e.g. a malformed
+// request the backend will never accept.
+func isRetryableTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
 	}
+	return strings.Contains(err.Error(), "connection refused")
 }
 
-func delHopHeaders(header http.Header) {
-	for _, h := range hopHeaders {
-		header.Del(h)
+// backoffDelay returns a jittered exponential backoff delay for the given
+// retry attempt (1-indexed), capped at maxDelay.
+func backoffDelay(base, maxDelay time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
 	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// retryTransport wraps an http.RoundTripper with retries for idempotent
+// requests and a circuit breaker guarding the backend as a whole.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	breaker    *circuitBreaker
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	retryable := isIdempotentMethod(req.Method)
+	var bodyBytes []byte
+	if retryable && req.Body != nil && req.ContentLength > 0 && req.ContentLength <= maxBufferedBodySize {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			t.breaker.recordFailure()
+			return nil, err
+		}
+		bodyBytes = b
+		req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	}
+
+	attempts := 1
+	if retryable {
+		attempts = t.maxRetries + 1
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoffDelay(t.baseDelay, t.maxDelay, attempt-1))
+			if bodyBytes != nil {
+				req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			}
+		}
+		resp, err = t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			t.breaker.recordSuccess()
+			return resp, nil
+		}
+		if err != nil && !isRetryableTransportError(err) {
+			break
+		}
+		if attempt < attempts && err == nil {
+			resp.Body.Close()
+		}
+	}
+	t.breaker.recordFailure()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// healthzHandler reports the circuit breaker's state so operators/orchestrators
+// can observe whether the proxy considers its backend healthy.
+func healthzHandler(breaker *circuitBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := breaker.status()
+		w.Header().Set("Content-Type", "application/json")
+		if status == breakerOpen.String() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"circuit_breaker": status})
+	})
 }
 
 func main() {
 	var localPort int
 	var remotePort int
+	var flushInterval time.Duration
+	var sessionID string
+	var agentHostname string
+	var policy accessPolicy
+	var rate float64
+	var burst int
+	var maxRetries int
+	var retryBaseDelay time.Duration
+	var retryMaxDelay time.Duration
+	var breakerThreshold int
+	var breakerCooldown time.Duration
 	flag.IntVar(&localPort, "port", 50128, "Target port for proxy to listen")
 	flag.IntVar(&remotePort, "remote-port", 8000, "Remote metadata server listening port")
+	flag.DurationVar(&flushInterval, "flush-interval", 0, "Flush interval to flush to the client while streaming a response; zero disables periodic flushing, negative flushes after every write")
+	flag.StringVar(&sessionID, "session-id", "", "Compute session ID to stamp onto responses via X-BackendAI-Session-ID")
+	flag.StringVar(&agentHostname, "agent-hostname", "", "Agent hostname to stamp onto responses via X-BackendAI-Agent-Hostname")
+	flag.Var(&policy.allow, "allow", `Regexp matched against the request path, or a shell-style glob if prefixed with "glob:" (e.g. "glob:/session/*/files"); if any -allow is given, only matching paths are forwarded (repeatable)`)
+	flag.Var(&policy.deny, "deny", `Regexp matched against the request path, or a shell-style glob if prefixed with "glob:"; matching paths are always rejected with 403 (repeatable, in addition to a built-in denylist)`)
+	flag.Float64Var(&rate, "rate", 50, "Allowed requests per second per client address")
+	flag.IntVar(&burst, "burst", 100, "Burst size for the per-client rate limiter")
+	flag.IntVar(&maxRetries, "max-retries", 2, "Maximum retries for idempotent requests against the backend")
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", 50*time.Millisecond, "Base delay for retry backoff, doubled on each attempt")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", 2*time.Second, "Maximum retry backoff delay")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 5, "Consecutive backend failures before the circuit breaker trips open")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 10*time.Second, "How long the circuit breaker stays open before probing the backend again")
+	flag.DurationVar(&upgradeIdleTimeout, "upgrade-idle-timeout", upgradeIdleTimeout, "How long a backend connection, including a tunneled Upgrade connection (e.g. WebSocket), may sit idle before it is closed")
 	flag.Parse()
+
+	for _, pattern := range defaultDenyPatterns {
+		policy.deny = append(policy.deny, regexp.MustCompile(pattern))
+	}
+	limiter := newClientRateLimiter(rate, burst)
+	breaker := newCircuitBreaker(breakerThreshold, breakerCooldown)
+	transport := &retryTransport{
+		next:       newBackendTransport(upgradeIdleTimeout),
+		maxRetries: maxRetries,
+		baseDelay:  retryBaseDelay,
+		maxDelay:   retryMaxDelay,
+		breaker:    breaker,
+	}
+
+	backendAddr := "host.docker.internal:" + strconv.Itoa(remotePort)
+	proxy := newMetadataProxy(backendAddr, flushInterval, sessionID, agentHostname, transport)
+	mux := http.NewServeMux()
+	mux.Handle("/-/healthz", healthzHandler(breaker))
+	mux.Handle("/", withAccessControl(proxy, &policy, limiter))
 	server := &http.Server{
-		Addr: ":" + strconv.Itoa(localPort),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			handleHTTP(w, r, remotePort)
-		}),
+		Addr:    ":" + strconv.Itoa(localPort),
+		Handler: mux,
 	}
 	log.Printf("Listening on 0.0.0.0:%d -> host.docker.internal:%d\n", localPort, remotePort)
 	log.Fatal(server.ListenAndServe())
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubRoundTripper replays a fixed sequence of responses/errors and records
+// the request body seen on each call, so retry/rewind behavior can be
+// asserted without a real backend.
+type stubRoundTripper struct {
+	responses []*http.Response
+	calls     int
+	bodies    []string
+}
+
+func (s *stubRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		s.bodies = append(s.bodies, string(b))
+	}
+	resp := s.responses[s.calls]
+	s.calls++
+	return resp, nil
+}
+
+func newStubResponse(status int) *http.Response {
+	return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(nil)), Header: make(http.Header)}
+}
+
+func newTestRetryTransport(next http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		next:       next,
+		maxRetries: 2,
+		baseDelay:  time.Millisecond,
+		maxDelay:   10 * time.Millisecond,
+		breaker:    newCircuitBreaker(5, time.Second),
+	}
+}
+
+func TestRetryTransportRetriesIdempotentOn5xxThenSucceeds(t *testing.T) {
+	stub := &stubRoundTripper{responses: []*http.Response{newStubResponse(http.StatusServiceUnavailable), newStubResponse(http.StatusOK)}}
+	rt := newTestRetryTransport(stub)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend/meta", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if stub.calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", stub.calls)
+	}
+}
+
+func TestRetryTransportDoesNotRetryNonIdempotentMethods(t *testing.T) {
+	stub := &stubRoundTripper{responses: []*http.Response{newStubResponse(http.StatusServiceUnavailable)}}
+	rt := newTestRetryTransport(stub)
+
+	req := httptest.NewRequest(http.MethodPost, "http://backend/meta", bytes.NewReader([]byte("body")))
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected exactly 1 attempt for POST, got %d", stub.calls)
+	}
+}
+
+func TestRetryTransportRewindsBufferedBodyAcrossRetries(t *testing.T) {
+	stub := &stubRoundTripper{responses: []*http.Response{newStubResponse(http.StatusServiceUnavailable), newStubResponse(http.StatusOK)}}
+	rt := newTestRetryTransport(stub)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend/meta", bytes.NewReader([]byte("q=1")))
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stub.bodies) != 2 || stub.bodies[0] != "q=1" || stub.bodies[1] != "q=1" {
+		t.Fatalf("expected body replayed on both attempts, got %v", stub.bodies)
+	}
+}
+
+func TestCircuitBreakerTripsAndRecoversAfterCooldown(t *testing.T) {
+	b := newCircuitBreaker(2, 10*time.Millisecond)
+
+	if !b.allow() {
+		t.Fatal("expected closed breaker to allow")
+	}
+	b.recordFailure()
+	if !b.allow() {
+		t.Fatal("expected breaker to still allow below threshold")
+	}
+	b.recordFailure()
+	if b.status() != "open" {
+		t.Fatalf("expected breaker to trip open, got %s", b.status())
+	}
+	if b.allow() {
+		t.Fatal("expected open breaker to deny immediately")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("expected breaker to admit a half-open trial after cooldown")
+	}
+	b.recordSuccess()
+	if b.status() != "closed" {
+		t.Fatalf("expected breaker to close after a successful trial, got %s", b.status())
+	}
+}
+
+func TestCircuitBreakerReopensOnFailedHalfOpenTrial(t *testing.T) {
+	b := newCircuitBreaker(1, 10*time.Millisecond)
+
+	b.recordFailure()
+	if b.status() != "open" {
+		t.Fatalf("expected breaker to trip open, got %s", b.status())
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("expected breaker to admit a half-open trial after cooldown")
+	}
+	b.recordFailure()
+	if b.status() != "open" {
+		t.Fatalf("expected breaker to reopen after a failed trial, got %s", b.status())
+	}
+}